@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// normalizeBucketLocation maps the LocationConstraint returned by
+// GetBucketLocation to an actual region name: S3 returns an empty string
+// for buckets in us-east-1 instead of the region name itself.
+func normalizeBucketLocation(lc s3Types.BucketLocationConstraint) string {
+	if lc == "" {
+		return "us-east-1"
+	}
+	return string(lc)
+}
+
+// buildClient loads the AWS config and constructs an S3 client for bucket.
+// If region and endpointURL are both empty, it looks up the bucket's region
+// with GetBucketLocation first, the same way the CLI always has, so that
+// callers don't need one region/endpoint per bucket.
+func buildClient(ctx context.Context, bucket, profile, region, endpointURL, caBundle string, noVerifySsl, noSignRequest, usePathStyle, debug bool) (*s3.Client, error) {
+	cfg, err := config.LoadDefaultConfig(
+		ctx,
+		func(o *config.LoadOptions) error {
+			if profile != "" {
+				o.SharedConfigProfile = profile
+			}
+			if caBundle != "" {
+				f, err := os.Open(caBundle)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+				o.CustomCABundle = f
+			}
+			if noVerifySsl {
+				o.HTTPClient = &http.Client{
+					Transport: &http.Transport{
+						TLSClientConfig: &tls.Config{
+							InsecureSkipVerify: true,
+						},
+					},
+				}
+			}
+			if debug {
+				var lm aws.ClientLogMode = aws.LogRequest | aws.LogResponse
+				o.ClientLogMode = &lm
+			}
+			return nil
+		},
+		config.WithAssumeRoleCredentialOptions(func(o *stscreds.AssumeRoleOptions) {
+			o.TokenProvider = mfaTokenProvider
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if !noSignRequest {
+		creds, _ := cfg.Credentials.Retrieve(ctx)
+		if creds.AccessKeyID == "" {
+			fmt.Fprintln(os.Stderr, "Warning: AWS credentials were not found. Please set up your AWS credentials.")
+		}
+	}
+
+	client := s3.NewFromConfig(cfg,
+		func(o *s3.Options) {
+			if noSignRequest {
+				o.Credentials = aws.AnonymousCredentials{}
+			}
+			if region != "" {
+				o.Region = region
+			}
+			if endpointURL != "" {
+				o.BaseEndpoint = aws.String(endpointURL)
+			}
+			if usePathStyle {
+				o.UsePathStyle = true
+			}
+		})
+
+	// Get the bucket location
+	if endpointURL == "" && region == "" {
+		bucketLocationOutput, err := client.GetBucketLocation(ctx, &s3.GetBucketLocationInput{
+			Bucket: aws.String(bucket),
+		})
+		if err != nil {
+			return nil, err
+		}
+		bucketRegion := normalizeBucketLocation(bucketLocationOutput.LocationConstraint)
+		if debug {
+			fmt.Fprintf(os.Stderr, "Bucket region: %s\n", bucketRegion)
+		}
+		client = s3.NewFromConfig(cfg, func(o *s3.Options) {
+			if v, ok := os.LookupEnv("AWS_USE_DUALSTACK_ENDPOINT"); !ok || v != "false" {
+				o.EndpointOptions.UseDualStackEndpoint = aws.DualStackEndpointStateEnabled
+			}
+			if noSignRequest {
+				o.Credentials = aws.AnonymousCredentials{}
+			}
+			o.Region = bucketRegion
+		})
+	}
+
+	return client, nil
+}
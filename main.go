@@ -2,23 +2,14 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
-	"encoding/base64"
 	"errors"
 	"fmt"
-	"io"
-	"math"
 	"net"
-	"net/http"
 	"net/url"
 	"os"
+	"runtime"
 	"strings"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
 	flag "github.com/stefansundin/go-zflag"
 )
@@ -34,13 +25,28 @@ func init() {
 }
 
 func main() {
-	var profile, region, endpointURL, caBundle, versionId string
-	var noVerifySsl, noSignRequest, usePathStyle, debug, versionFlag, helpFlag bool
+	var profile, region, endpointURL, caBundle, versionId, partSizeStr, outputMismatches, checkManifest, emitManifestPath, sseCKeyFile, sseCKeyMD5 string
+	var noVerifySsl, noSignRequest, usePathStyle, debug, versionFlag, helpFlag, checkParts, etagMode, requestPayer bool
+	var parallel, concurrency int
+	var excludes, includes []string
 	flag.StringVar(&profile, "profile", "", "Use a specific profile from your credential file.")
 	flag.StringVar(&region, "region", "", "The region to use. Overrides config/env settings. Avoids one API call.")
 	flag.StringVar(&endpointURL, "endpoint-url", "", "Override the S3 endpoint URL. (for use with S3 compatible APIs)")
 	flag.StringVar(&caBundle, "ca-bundle", "", "The CA certificate bundle to use when verifying SSL certificates.")
 	flag.StringVar(&versionId, "version-id", "", "Version ID used to reference a specific version of the S3 object.")
+	flag.IntVar(&parallel, "parallel", runtime.NumCPU(), "Number of parts to hash concurrently for multipart objects. Only used when LocalPath supports concurrent reads (i.e. not stdin).")
+	flag.BoolVar(&checkParts, "check-parts", false, "For objects with a FULL_OBJECT checksum, also cross-check each part's checksum against the local file. This is purely informational; the FULL_OBJECT checksum is already authoritative.")
+	flag.BoolVar(&etagMode, "etag", false, "If the object was not uploaded using the additional checksum feature, fall back to verifying against its ETag using the classic S3 algorithm (MD5, or MD5-of-MD5s for multipart objects).")
+	flag.StringVar(&partSizeStr, "part-size", "", "The part size used when the object was uploaded with multipart upload. Only used by --etag mode when the part boundaries cannot be determined from GetObjectAttributes. Accepts a byte count or a size with a KiB/MiB/GiB suffix, e.g. 8MiB. If omitted, a handful of common part sizes are probed automatically.")
+	flag.IntVar(&concurrency, "concurrency", 10, "Number of keys to verify concurrently when S3Uri is a prefix and LocalPath is a directory.")
+	flag.StringArrayVar(&excludes, "exclude", nil, "Glob pattern of keys to exclude from a recursive prefix verification. Can be given multiple times.")
+	flag.StringArrayVar(&includes, "include", nil, "Glob pattern of keys to include in a recursive prefix verification (applied after --exclude). Can be given multiple times.")
+	flag.StringVar(&outputMismatches, "output-mismatches", "", "During a recursive prefix verification, write the keys that did not match, one per line, to this file.")
+	flag.StringVar(&checkManifest, "check", "", "Read a manifest produced by --emit-manifest (or in the same format) and verify every entry's checksum via GetObjectAttributes, reporting OK/FAILED/MISSING per entry. LocalPath and S3Uri must not be given together with this.")
+	flag.StringVar(&emitManifestPath, "emit-manifest", "", "On a successful verification, append the object's checksum, algorithm, and S3Uri to this file as a manifest entry for later use with --check.")
+	flag.StringVar(&sseCKeyFile, "sse-c-key", "", "File containing the SSE-C key to use when accessing an object encrypted with server-side encryption with customer-provided keys. Accepts the raw 32-byte key or its base64 encoding.")
+	flag.StringVar(&sseCKeyMD5, "sse-c-key-md5", "", "The base64-encoded MD5 of the --sse-c-key. Computed automatically if not given.")
+	flag.BoolVar(&requestPayer, "request-payer", false, "Confirm that you will pay for requests to a requester-pays bucket.")
 	flag.BoolVar(&noVerifySsl, "no-verify-ssl", false, "Do not verify SSL certificates.")
 	flag.BoolVar(&noSignRequest, "no-sign-request", false, "Do not sign requests. This does not work with Amazon S3, but may work with other S3 APIs.")
 	flag.BoolVar(&usePathStyle, "use-path-style", false, "Use S3 Path Style.")
@@ -59,6 +65,9 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] <LocalPath> <S3Uri>\n", os.Args[0])
 		fmt.Fprintln(os.Stderr, "LocalPath can be - for stdin.")
 		fmt.Fprintln(os.Stderr, "S3Uri must have the format s3://<bucketname>/<key>.")
+		fmt.Fprintln(os.Stderr, "If S3Uri ends with / and LocalPath is a directory, the prefix is verified recursively against the directory.")
+		fmt.Fprintln(os.Stderr, "--check FILE instead verifies every entry of a manifest, and takes no LocalPath/S3Uri.")
+		fmt.Fprintln(os.Stderr, "--sse-c-key and --request-payer are needed to access SSE-C encrypted or requester-pays objects.")
 		fmt.Fprintln(os.Stderr)
 		fmt.Fprintln(os.Stderr, "Options:")
 		flag.PrintDefaults()
@@ -71,6 +80,13 @@ func main() {
 	} else if helpFlag {
 		flag.Usage()
 		os.Exit(0)
+	} else if checkManifest != "" {
+		if flag.NArg() > 0 {
+			flag.Usage()
+			fmt.Fprintln(os.Stderr)
+			fmt.Fprintln(os.Stderr, "Error: --check does not take LocalPath/S3Uri arguments.")
+			os.Exit(1)
+		}
 	} else if flag.NArg() < 2 {
 		flag.Usage()
 		fmt.Fprintln(os.Stderr)
@@ -104,271 +120,125 @@ func main() {
 		}
 	}
 
-	localPath := flag.Arg(0)
-	bucket, key := parseS3Uri(flag.Arg(1))
-	if bucket == "" || key == "" {
-		fmt.Fprintln(os.Stderr, "Error: The S3Uri must have the format s3://<bucketname>/<key>")
+	if parallel < 1 {
+		fmt.Fprintln(os.Stderr, "Error: --parallel must be at least 1.")
 		os.Exit(1)
 	}
-
-	// Open the file
-	var f *os.File
-	if localPath == "-" {
-		f = os.Stdin
-	} else {
-		var err error
-		f, err = os.Open(localPath)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
-		}
-		defer f.Close()
-	}
-
-	// Initialize the AWS SDK
-	cfg, err := config.LoadDefaultConfig(
-		context.TODO(),
-		func(o *config.LoadOptions) error {
-			if profile != "" {
-				o.SharedConfigProfile = profile
-			}
-			if caBundle != "" {
-				f, err := os.Open(caBundle)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, err)
-					os.Exit(1)
-				}
-				o.CustomCABundle = f
-			}
-			if noVerifySsl {
-				o.HTTPClient = &http.Client{
-					Transport: &http.Transport{
-						TLSClientConfig: &tls.Config{
-							InsecureSkipVerify: true,
-						},
-					},
-				}
-			}
-			if debug {
-				var lm aws.ClientLogMode = aws.LogRequest | aws.LogResponse
-				o.ClientLogMode = &lm
-			}
-			return nil
-		},
-		config.WithAssumeRoleCredentialOptions(func(o *stscreds.AssumeRoleOptions) {
-			o.TokenProvider = mfaTokenProvider
-		}),
-	)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+	if concurrency < 1 {
+		fmt.Fprintln(os.Stderr, "Error: --concurrency must be at least 1.")
 		os.Exit(1)
 	}
 
-	if !noSignRequest {
-		creds, _ := cfg.Credentials.Retrieve(context.TODO())
-		if creds.AccessKeyID == "" {
-			fmt.Fprintln(os.Stderr, "Warning: AWS credentials were not found. Please set up your AWS credentials.")
+	var partSize int64
+	if partSizeStr != "" {
+		var err error
+		partSize, err = parseSize(partSizeStr)
+		if err != nil || partSize <= 0 {
+			fmt.Fprintln(os.Stderr, "Error: --part-size must be a positive byte count, optionally with a KiB/MiB/GiB suffix.")
+			os.Exit(1)
 		}
 	}
 
-	client := s3.NewFromConfig(cfg,
-		func(o *s3.Options) {
-			if noSignRequest {
-				o.Credentials = aws.AnonymousCredentials{}
-			}
-			if region != "" {
-				o.Region = region
-			}
-			if endpointURL != "" {
-				o.BaseEndpoint = aws.String(endpointURL)
-			}
-			if usePathStyle {
-				o.UsePathStyle = true
-			}
-		})
-
-	// Get the bucket location
-	if endpointURL == "" && region == "" {
-		bucketLocationOutput, err := client.GetBucketLocation(context.TODO(), &s3.GetBucketLocationInput{
-			Bucket: aws.String(bucket),
-		})
+	var sseCustomerKey, sseCustomerKeyMD5 string
+	if sseCKeyFile != "" {
+		var err error
+		sseCustomerKey, sseCustomerKeyMD5, err = loadSSECustomerKey(sseCKeyFile)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
-			var ae smithy.APIError
-			if errors.As(err, &ae) && ae.ErrorCode() == "AccessDenied" {
-				fmt.Fprintln(os.Stderr, "\nYou can use --region to manually specify the bucket region.")
-			}
 			os.Exit(1)
 		}
-		bucketRegion := normalizeBucketLocation(bucketLocationOutput.LocationConstraint)
-		if debug {
-			fmt.Fprintf(os.Stderr, "Bucket region: %s\n", bucketRegion)
+		if sseCKeyMD5 != "" {
+			sseCustomerKeyMD5 = sseCKeyMD5
 		}
-		client = s3.NewFromConfig(cfg, func(o *s3.Options) {
-			if v, ok := os.LookupEnv("AWS_USE_DUALSTACK_ENDPOINT"); !ok || v != "false" {
-				o.EndpointOptions.UseDualStackEndpoint = aws.DualStackEndpointStateEnabled
-			}
-			if noSignRequest {
-				o.Credentials = aws.AnonymousCredentials{}
-			}
-			o.Region = bucketRegion
-		})
 	}
 
-	fmt.Fprintln(os.Stderr, "Fetching S3 object information...")
-	if debug {
-		fmt.Fprintln(os.Stderr)
+	if checkManifest != "" {
+		os.Exit(runCheckManifest(context.TODO(), checkManifest, profile, region, endpointURL, caBundle, noVerifySsl, noSignRequest, usePathStyle, debug, sseCustomerKey, sseCustomerKeyMD5, requestPayer))
 	}
 
-	getObjectAttributesInput := &s3.GetObjectAttributesInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-		ObjectAttributes: []s3Types.ObjectAttributes{
-			s3Types.ObjectAttributesChecksum,
-			s3Types.ObjectAttributesObjectParts,
-			s3Types.ObjectAttributesObjectSize,
-		},
-		MaxParts: aws.Int32(100000),
-	}
-	if versionId != "" {
-		getObjectAttributesInput.VersionId = aws.String(versionId)
-	}
-	objAttrs, err := client.GetObjectAttributes(context.TODO(), getObjectAttributesInput)
-	if err != nil {
-		if isSmithyErrorCode(err, 404) {
-			fmt.Fprintln(os.Stderr, "Error: The object does not exist.")
-		} else {
-			fmt.Fprintln(os.Stderr, err)
-		}
-		os.Exit(1)
-	}
-
-	if debug {
-		fmt.Fprintln(os.Stderr, string(jsonMustMarshalSortedIndent(objAttrs, "", "  ")))
-		fmt.Fprintln(os.Stderr)
-	}
-
-	if objAttrs.Checksum == nil {
-		fmt.Fprintln(os.Stderr, "Error: This S3 object was not uploaded using the additional checksum feature. s3verify requires that the object is uploaded with this feature enabled. Please consult https://docs.aws.amazon.com/AmazonS3/latest/userguide/checking-object-integrity.html")
-		fmt.Fprintln(os.Stderr)
-		fmt.Fprintln(os.Stderr, "You may also find s3sha256sum useful: https://github.com/stefansundin/s3sha256sum")
+	localPath := flag.Arg(0)
+	bucket, key := parseS3Uri(flag.Arg(1))
+	if bucket == "" || (key == "" && !strings.HasSuffix(flag.Arg(1), "/")) {
+		fmt.Fprintln(os.Stderr, "Error: The S3Uri must have the format s3://<bucketname>/<key>")
 		os.Exit(1)
 	}
 
-	// Compare the file sizes if possible
-	if localPath != "-" {
+	// A trailing slash on the key turns S3Uri into a prefix: verify it
+	// recursively against LocalPath instead of a single object. An empty key
+	// (s3://<bucketname>/) is the whole bucket.
+	recursive := key == "" || strings.HasSuffix(key, "/")
+	if recursive {
 		stat, err := os.Stat(localPath)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+		if err != nil || !stat.IsDir() {
+			fmt.Fprintln(os.Stderr, "Error: S3Uri is a prefix (ends with /), so LocalPath must be an existing directory.")
 			os.Exit(1)
 		}
-		fileSize := stat.Size()
-		objectSize := aws.ToInt64(objAttrs.ObjectSize)
-		if objectSize != fileSize {
-			fmt.Fprintf(os.Stderr, "Error: The size of the S3 object (%d bytes) does not match the size of the local file (%d bytes).\n", objectSize, fileSize)
+		if versionId != "" {
+			fmt.Fprintln(os.Stderr, "Error: --version-id cannot be used with a recursive prefix verification, since it identifies a single object version.")
 			os.Exit(1)
 		}
 	}
 
-	algorithm, err := getChecksumAlgorithm(objAttrs.Checksum)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "This S3 object was uploaded using an unsupported checksum algorithm. Please file an issue: https://github.com/stefansundin/s3verify")
-		os.Exit(1)
-	}
-	objSum, err := getChecksum(objAttrs.Checksum, algorithm)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	// Open the file
+	var f *os.File
+	if !recursive {
+		if localPath == "-" {
+			f = os.Stdin
+		} else {
+			var err error
+			f, err = os.Open(localPath)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			defer f.Close()
+		}
 	}
-	h, err := newHash(algorithm)
+
+	client, err := buildClient(context.TODO(), bucket, profile, region, endpointURL, caBundle, noVerifySsl, noSignRequest, usePathStyle, debug)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
+		var ae smithy.APIError
+		if errors.As(err, &ae) && ae.ErrorCode() == "AccessDenied" {
+			fmt.Fprintln(os.Stderr, "\nYou can use --region to manually specify the bucket region.")
+		}
 		os.Exit(1)
 	}
 
-	fmt.Printf("S3 object checksum: %s\n", objSum)
-
-	if objAttrs.ObjectParts == nil {
-		// Not a multi-part object:
-		_, err = io.Copy(h, f)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
-		}
-		sum := base64.StdEncoding.EncodeToString(h.Sum(nil))
-		fmt.Println()
-		fmt.Printf("Local file checksum: %s\n", sum)
-		fmt.Println()
-		if sum != objSum {
-			fmt.Println("Checksum MISMATCH! File and S3 object are NOT identical!")
-			os.Exit(1)
-		}
-		fmt.Println("Checksum matches! File and S3 object are identical.")
-		os.Exit(0)
+	opts := verifyOptions{
+		parallel:          parallel,
+		checkParts:        checkParts,
+		etagMode:          etagMode,
+		partSize:          partSize,
+		emitManifestPath:  emitManifestPath,
+		sseCustomerKey:    sseCustomerKey,
+		sseCustomerKeyMD5: sseCustomerKeyMD5,
+		requestPayer:      requestPayer,
 	}
 
-	// A multi-part object:
-	numParts := int(aws.ToInt32(objAttrs.ObjectParts.TotalPartsCount))
-	fmt.Printf("Object consists of %d part%s.\n", numParts, pluralize(numParts))
-	fmt.Println()
-
-	if numParts != len(objAttrs.ObjectParts.Parts) || aws.ToBool(objAttrs.ObjectParts.IsTruncated) {
-		fmt.Fprintln(os.Stderr, "This S3 object has more parts than were returned in the response. Please file an issue: https://github.com/stefansundin/s3verify")
-		os.Exit(1)
+	if recursive {
+		opts.debug = debug
+		opts.quiet = true
+		os.Exit(runRecursiveVerify(context.TODO(), client, bucket, key, localPath, versionId, concurrency, excludes, includes, outputMismatches, opts))
 	}
 
-	partLengthDigits := 1 + int64(math.Floor(math.Log10(float64(numParts))))
-	partFmtStr := fmt.Sprintf("Part %%%dd: %%s  ", partLengthDigits)
-
-	var offset int64
-	var partNumber int32 = 1
-	for _, part := range objAttrs.ObjectParts.Parts {
-		if partNumber != aws.ToInt32(part.PartNumber) {
-			fmt.Fprintln(os.Stderr, "The parts of the S3 object are not sorted in the response. Please file an issue: https://github.com/stefansundin/s3verify")
-			os.Exit(1)
-		}
-
-		partSize := aws.ToInt64(part.Size)
-		partHash, err := newHash(algorithm)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
-		}
-		_, err = io.Copy(partHash, io.LimitReader(f, partSize))
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
-		}
-		partSum := partHash.Sum(nil)
-		partSumEncoded := base64.StdEncoding.EncodeToString(partSum)
-		fmt.Printf(partFmtStr, partNumber, partSumEncoded)
-		partChecksum, err := getPartChecksum(&part, algorithm)
-		if err != nil {
+	opts.debug = debug
+	err = verifyObject(context.TODO(), client, bucket, key, versionId, f, localPath, opts)
+	if err != nil {
+		switch {
+		case errors.Is(err, errObjectNotFound):
+			fmt.Fprintln(os.Stderr, "Error: The object does not exist.")
+		case errors.Is(err, errNoChecksum):
+			fmt.Fprintln(os.Stderr, "Error: This S3 object was not uploaded using the additional checksum feature. s3verify requires that the object is uploaded with this feature enabled. Please consult https://docs.aws.amazon.com/AmazonS3/latest/userguide/checking-object-integrity.html")
+			fmt.Fprintln(os.Stderr)
+			fmt.Fprintln(os.Stderr, "You may also find s3sha256sum useful: https://github.com/stefansundin/s3sha256sum")
+			fmt.Fprintln(os.Stderr)
+			fmt.Fprintln(os.Stderr, "Alternatively, pass --etag to fall back to verifying against the object's ETag.")
+		case errors.Is(err, errMismatch):
+			fmt.Println("Checksum MISMATCH! File and S3 object are NOT identical!")
+		default:
 			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
-		}
-		if partSumEncoded != partChecksum {
-			fmt.Println("FAILED")
-			fmt.Println()
-			fmt.Printf("Local file did not match part %d (bytes %d to %d).\n", partNumber, offset, offset+partSize)
-			os.Exit(1)
 		}
-		fmt.Println("OK")
-		h.Write([]byte(partSum))
-		offset += partSize
-		partNumber++
-	}
-
-	sum := base64.StdEncoding.EncodeToString(h.Sum(nil))
-	if len(sum) != len(objSum) {
-		// Directory buckets add the number of parts to the end of the checksum of checksums, separated with a dash
-		sum = fmt.Sprintf("%s-%d", sum, numParts)
-	}
-	fmt.Println()
-	fmt.Printf("Checksum of checksums: %s\n", sum)
-	fmt.Println()
-	if sum != objSum {
-		fmt.Println("Checksum MISMATCH! File and S3 object are NOT identical!")
 		os.Exit(1)
 	}
 	fmt.Println("Checksum matches! File and S3 object are identical.")
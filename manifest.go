@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// manifestEntry is one line of a --check/--emit-manifest manifest: the
+// recorded checksum and algorithm for a single S3 object version.
+type manifestEntry struct {
+	Checksum  string `json:"checksum"`
+	Algorithm string `json:"algorithm"`
+	Bucket    string `json:"-"`
+	Key       string `json:"-"`
+	VersionId string `json:"-"`
+	S3Uri     string `json:"s3uri"`
+}
+
+// parseManifest reads a manifest file written by --emit-manifest (or hand
+// written in the same format): a JSON array of {checksum,algorithm,s3uri}
+// objects, or plain text with one "<checksum>  <algorithm>  <s3uri>" entry
+// per line. Blank lines and lines starting with # are ignored in the text
+// format.
+func parseManifest(path string) ([]manifestEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	trimmed := strings.TrimSpace(string(data))
+	if strings.HasPrefix(trimmed, "[") {
+		var entries []manifestEntry
+		if err := json.Unmarshal([]byte(trimmed), &entries); err != nil {
+			return nil, fmt.Errorf("could not parse %s as a JSON manifest: %w", path, err)
+		}
+		for i := range entries {
+			if err := entries[i].parseS3Uri(); err != nil {
+				return nil, err
+			}
+		}
+		return entries, nil
+	}
+
+	var entries []manifestEntry
+	scanner := bufio.NewScanner(strings.NewReader(trimmed))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("could not parse manifest line %q: expected \"<checksum> <algorithm> <s3uri>\"", line)
+		}
+		entry := manifestEntry{Checksum: fields[0], Algorithm: fields[1], S3Uri: fields[2]}
+		if err := entry.parseS3Uri(); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// parseS3Uri splits e.S3Uri into Bucket, Key and an optional ?versionId=...
+// query parameter.
+func (e *manifestEntry) parseS3Uri() error {
+	uri := e.S3Uri
+	if versionIdx := strings.Index(uri, "?versionId="); versionIdx != -1 {
+		e.VersionId = uri[versionIdx+len("?versionId="):]
+		uri = uri[:versionIdx]
+	}
+	e.Bucket, e.Key = parseS3Uri(uri)
+	if e.Bucket == "" || e.Key == "" {
+		return fmt.Errorf("could not parse manifest entry S3Uri %q", e.S3Uri)
+	}
+	return nil
+}
+
+// runCheckManifest implements --check: it reads the manifest at path and
+// reports OK/FAILED/MISSING for each entry, in the spirit of `sha256sum -c`.
+// It returns the process exit code: 0 if every entry matched, 1 otherwise.
+func runCheckManifest(ctx context.Context, path, profile, region, endpointURL, caBundle string, noVerifySsl, noSignRequest, usePathStyle, debug bool, sseCustomerKey, sseCustomerKeyMD5 string, requestPayer bool) int {
+	entries, err := parseManifest(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(entries) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: the manifest is empty.")
+		return 1
+	}
+
+	clients := make(map[string]*s3.Client)
+	var ok, failed, missing int
+	for _, entry := range entries {
+		client, present := clients[entry.Bucket]
+		if !present {
+			client, err = buildClient(ctx, entry.Bucket, profile, region, endpointURL, caBundle, noVerifySsl, noSignRequest, usePathStyle, debug)
+			if err != nil {
+				fmt.Printf("FAILED   %s (%v)\n", entry.S3Uri, err)
+				failed++
+				continue
+			}
+			clients[entry.Bucket] = client
+		}
+
+		getObjectAttributesInput := &s3.GetObjectAttributesInput{
+			Bucket: aws.String(entry.Bucket),
+			Key:    aws.String(entry.Key),
+			ObjectAttributes: []s3Types.ObjectAttributes{
+				s3Types.ObjectAttributesChecksum,
+			},
+		}
+		if entry.VersionId != "" {
+			getObjectAttributesInput.VersionId = aws.String(entry.VersionId)
+		}
+		if sseCustomerKey != "" {
+			getObjectAttributesInput.SSECustomerAlgorithm = aws.String("AES256")
+			getObjectAttributesInput.SSECustomerKey = aws.String(sseCustomerKey)
+			getObjectAttributesInput.SSECustomerKeyMD5 = aws.String(sseCustomerKeyMD5)
+		}
+		if requestPayer {
+			getObjectAttributesInput.RequestPayer = s3Types.RequestPayerRequester
+		}
+		objAttrs, err := client.GetObjectAttributes(ctx, getObjectAttributesInput)
+		if err != nil {
+			if isSmithyErrorCode(err, 404) {
+				fmt.Printf("MISSING  %s\n", entry.S3Uri)
+				missing++
+				continue
+			}
+			if isSmithyErrorCode(err, 400) && sseCustomerKey != "" {
+				fmt.Printf("FAILED   %s (%v; the --sse-c-key may be incorrect for this object)\n", entry.S3Uri, err)
+				failed++
+				continue
+			}
+			fmt.Printf("FAILED   %s (%v)\n", entry.S3Uri, err)
+			failed++
+			continue
+		}
+
+		if objAttrs.Checksum == nil {
+			fmt.Printf("FAILED   %s (object has no additional checksum)\n", entry.S3Uri)
+			failed++
+			continue
+		}
+		checksum, err := getChecksum(objAttrs.Checksum, s3Types.ChecksumAlgorithm(entry.Algorithm))
+		if err != nil || checksum == "" {
+			fmt.Printf("FAILED   %s (object was not uploaded with a %s checksum)\n", entry.S3Uri, entry.Algorithm)
+			failed++
+			continue
+		}
+		if checksum != entry.Checksum {
+			fmt.Printf("FAILED   %s\n", entry.S3Uri)
+			failed++
+			continue
+		}
+		fmt.Printf("OK       %s\n", entry.S3Uri)
+		ok++
+	}
+
+	fmt.Println()
+	fmt.Printf("OK: %d, Failed: %d, Missing: %d\n", ok, failed, missing)
+
+	if failed > 0 || missing > 0 {
+		return 1
+	}
+	return 0
+}
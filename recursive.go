@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// runRecursiveVerify lists every object under prefix in bucket, matches each
+// one against the corresponding file under localDir, and verifies up to
+// concurrency of them at a time, in the spirit of `rclone check`. It returns
+// the process exit code: 0 if every key matched, 1 if any discrepancy was
+// found.
+func runRecursiveVerify(ctx context.Context, client *s3.Client, bucket, prefix, localDir, versionId string, concurrency int, excludes, includes []string, outputMismatches string, opts verifyOptions) int {
+	fmt.Fprintf(os.Stderr, "Listing s3://%s/%s ...\n", bucket, prefix)
+
+	remoteKeys := make(map[string]bool)
+	listInput := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	if opts.requestPayer {
+		listInput.RequestPayer = s3Types.RequestPayerRequester
+	}
+	paginator := s3.NewListObjectsV2Paginator(client, listInput)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			if key == prefix || strings.HasSuffix(key, "/") {
+				// Skip the prefix itself and "directory marker" objects.
+				continue
+			}
+			relKey := strings.TrimPrefix(key, prefix)
+			if !matchesFilters(relKey, excludes, includes) {
+				continue
+			}
+			remoteKeys[relKey] = true
+		}
+	}
+
+	localFiles := make(map[string]bool)
+	err := filepath.WalkDir(localDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(localDir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !matchesFilters(rel, excludes, includes) {
+			return nil
+		}
+		localFiles[rel] = true
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	allKeys := make(map[string]bool, len(remoteKeys))
+	for relKey := range remoteKeys {
+		allKeys[relKey] = true
+	}
+	for relKey := range localFiles {
+		allKeys[relKey] = true
+	}
+	sortedKeys := make([]string, 0, len(allKeys))
+	for relKey := range allKeys {
+		sortedKeys = append(sortedKeys, relKey)
+	}
+	sort.Strings(sortedKeys)
+
+	var (
+		mu                                            sync.Mutex
+		matched, mismatched, missingLocal, extraLocal []string
+	)
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, relKey := range sortedKeys {
+		_, inRemote := remoteKeys[relKey]
+		_, inLocal := localFiles[relKey]
+
+		if inRemote && !inLocal {
+			mu.Lock()
+			missingLocal = append(missingLocal, relKey)
+			mu.Unlock()
+			fmt.Printf("MISSING  %s (not present locally)\n", relKey)
+			continue
+		}
+		if inLocal && !inRemote {
+			mu.Lock()
+			extraLocal = append(extraLocal, relKey)
+			mu.Unlock()
+			fmt.Printf("EXTRA    %s (not present in S3)\n", relKey)
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(relKey string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			localFilePath := filepath.Join(localDir, filepath.FromSlash(relKey))
+			f, err := os.Open(localFilePath)
+			if err != nil {
+				mu.Lock()
+				mismatched = append(mismatched, relKey)
+				mu.Unlock()
+				fmt.Printf("FAILED   %s (%v)\n", relKey, err)
+				return
+			}
+			defer f.Close()
+
+			key := prefix + relKey
+			if err := verifyObject(ctx, client, bucket, key, versionId, f, localFilePath, opts); err != nil {
+				mu.Lock()
+				mismatched = append(mismatched, relKey)
+				mu.Unlock()
+				fmt.Printf("FAILED   %s (%v)\n", relKey, err)
+				return
+			}
+			mu.Lock()
+			matched = append(matched, relKey)
+			mu.Unlock()
+			fmt.Printf("OK       %s\n", relKey)
+		}(relKey)
+	}
+	wg.Wait()
+
+	if outputMismatches != "" {
+		offending := make([]string, 0, len(mismatched)+len(missingLocal)+len(extraLocal))
+		offending = append(offending, mismatched...)
+		offending = append(offending, missingLocal...)
+		offending = append(offending, extraLocal...)
+		sort.Strings(offending)
+		content := ""
+		if len(offending) > 0 {
+			content = strings.Join(offending, "\n") + "\n"
+		}
+		if err := os.WriteFile(outputMismatches, []byte(content), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+
+	fmt.Println()
+	fmt.Printf("Matched: %d, Mismatched: %d, Missing locally: %d, Extra locally: %d\n", len(matched), len(mismatched), len(missingLocal), len(extraLocal))
+
+	if len(mismatched) > 0 || len(missingLocal) > 0 || len(extraLocal) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// matchesFilters reports whether relKey should be processed: it is dropped
+// by a matching --exclude pattern, then (if any --include patterns were
+// given) it must match at least one of them.
+func matchesFilters(relKey string, excludes, includes []string) bool {
+	for _, pattern := range excludes {
+		if ok, _ := path.Match(pattern, relKey); ok {
+			return false
+		}
+	}
+	if len(includes) == 0 {
+		return true
+	}
+	for _, pattern := range includes {
+		if ok, _ := path.Match(pattern, relKey); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -1,20 +1,33 @@
 package main
 
 import (
+	"bytes"
+	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"hash"
 	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	smithyhttp "github.com/aws/smithy-go/transport/http"
 )
 
+// crc64NvmeTable is the CRC-64/NVME table. The NVMe spec gives the polynomial
+// as 0xad93d23594c93659 in normal (MSB-first) form, but crc64.MakeTable expects
+// it bit-reflected like the stdlib's ISO and ECMA tables, hence 0x9a6c9329ac4bc9b5.
+var crc64NvmeTable = crc64.MakeTable(0x9a6c9329ac4bc9b5)
+
 func pluralize(n int) string {
 	if n == 1 {
 		return ""
@@ -65,6 +78,98 @@ func parseS3Uri(s string) (string, string) {
 	}
 }
 
+// parseSize parses a byte count, optionally suffixed with KiB/MiB/GiB (case
+// insensitive), as used by the --part-size flag.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	multiplier := int64(1)
+	switch lower := strings.ToLower(s); {
+	case strings.HasSuffix(lower, "kib"):
+		multiplier = 1024
+		s = s[:len(s)-3]
+	case strings.HasSuffix(lower, "mib"):
+		multiplier = 1024 * 1024
+		s = s[:len(s)-3]
+	case strings.HasSuffix(lower, "gib"):
+		multiplier = 1024 * 1024 * 1024
+		s = s[:len(s)-3]
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", s, err)
+	}
+	return n * multiplier, nil
+}
+
+// resolvePartSizes determines the size of each part of a multipart object
+// for --etag mode. If parts (from GetObjectAttributes) already accounts for
+// every part, its sizes are used directly. Otherwise, it falls back to
+// partSizeHint if given, or probes a handful of common part sizes used by
+// popular S3 clients, plus objectSize/numParts when that divides evenly.
+func resolvePartSizes(parts []s3Types.ObjectPart, numParts int, objectSize int64, partSizeHint int64) ([]int64, error) {
+	if len(parts) == numParts {
+		sizes := make([]int64, numParts)
+		for i, part := range parts {
+			sizes[i] = aws.ToInt64(part.Size)
+		}
+		return sizes, nil
+	}
+
+	if partSizeHint > 0 {
+		return sizesFromPartSize(partSizeHint, numParts, objectSize)
+	}
+
+	candidates := []int64{5 << 20, 8 << 20, 16 << 20, 64 << 20, 128 << 20}
+	if objectSize%int64(numParts) == 0 {
+		candidates = append([]int64{objectSize / int64(numParts)}, candidates...)
+	}
+	for _, candidate := range candidates {
+		if sizes, err := sizesFromPartSize(candidate, numParts, objectSize); err == nil {
+			return sizes, nil
+		}
+	}
+	return nil, fmt.Errorf("could not determine the part size used to upload this object")
+}
+
+// sizesFromPartSize splits objectSize into numParts parts of partSize bytes,
+// with the remainder in the last part, the way S3 multipart uploads do. It
+// fails if partSize doesn't actually divide objectSize into numParts parts.
+func sizesFromPartSize(partSize int64, numParts int, objectSize int64) ([]int64, error) {
+	sizes := make([]int64, numParts)
+	var total int64
+	for i := 0; i < numParts-1; i++ {
+		sizes[i] = partSize
+		total += partSize
+	}
+	lastSize := objectSize - total
+	if lastSize <= 0 || lastSize > partSize {
+		return nil, fmt.Errorf("part size %d does not divide object size %d into %d parts", partSize, objectSize, numParts)
+	}
+	sizes[numParts-1] = lastSize
+	return sizes, nil
+}
+
+// loadSSECustomerKey reads an SSE-C key from path, which holds either the raw
+// 32-byte key or its base64 encoding, and returns the base64-encoded key
+// together with the base64-encoded MD5 of the raw key, in the form the S3 API
+// expects for SSECustomerKey/SSECustomerKeyMD5.
+func loadSSECustomerKey(path string) (key, keyMD5 string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	raw := bytes.TrimRight(data, "\n")
+	if len(raw) != 32 {
+		decoded, decErr := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+		if decErr != nil || len(decoded) != 32 {
+			return "", "", fmt.Errorf("the SSE-C key in %s must be exactly 32 raw bytes, or their base64 encoding", path)
+		}
+		raw = decoded
+	}
+	sum := md5.Sum(raw)
+	return base64.StdEncoding.EncodeToString(raw), base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
 func mfaTokenProvider() (string, error) {
 	for {
 		fmt.Printf("Assume Role MFA token code: ")
@@ -94,6 +199,8 @@ func getChecksumAlgorithm(v *s3Types.Checksum) (s3Types.ChecksumAlgorithm, error
 		return s3Types.ChecksumAlgorithmCrc32, nil
 	} else if v.ChecksumCRC32C != nil {
 		return s3Types.ChecksumAlgorithmCrc32c, nil
+	} else if v.ChecksumCRC64NVME != nil {
+		return s3Types.ChecksumAlgorithmCrc64nvme, nil
 	}
 	return "", fmt.Errorf("unsupported checksum algorithm")
 }
@@ -108,6 +215,8 @@ func getChecksum(v *s3Types.Checksum, algorithm s3Types.ChecksumAlgorithm) (stri
 		return aws.ToString(v.ChecksumCRC32), nil
 	case s3Types.ChecksumAlgorithmCrc32c:
 		return aws.ToString(v.ChecksumCRC32C), nil
+	case s3Types.ChecksumAlgorithmCrc64nvme:
+		return aws.ToString(v.ChecksumCRC64NVME), nil
 	default:
 		return "", fmt.Errorf("unsupported checksum algorithm, %v", algorithm)
 	}
@@ -123,6 +232,8 @@ func getPartChecksum(v *s3Types.ObjectPart, algorithm s3Types.ChecksumAlgorithm)
 		return aws.ToString(v.ChecksumCRC32), nil
 	case s3Types.ChecksumAlgorithmCrc32c:
 		return aws.ToString(v.ChecksumCRC32C), nil
+	case s3Types.ChecksumAlgorithmCrc64nvme:
+		return aws.ToString(v.ChecksumCRC64NVME), nil
 	default:
 		return "", fmt.Errorf("unsupported checksum algorithm: %v", algorithm)
 	}
@@ -139,7 +250,110 @@ func newHash(v s3Types.ChecksumAlgorithm) (hash.Hash, error) {
 		return crc32.NewIEEE(), nil
 	case s3Types.ChecksumAlgorithmCrc32c:
 		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	case s3Types.ChecksumAlgorithmCrc64nvme:
+		return crc64.New(crc64NvmeTable), nil
 	default:
 		return nil, fmt.Errorf("unsupported checksum algorithm, %v", v)
 	}
 }
+
+// partHashResult is the outcome of hashing a single part: either its digest
+// or the error encountered while reading it.
+type partHashResult struct {
+	sum []byte
+	err error
+}
+
+// indexedPartHashResult pairs a partHashResult with the index of the part it
+// belongs to, since hashParts' workers finish in whatever order their reads
+// complete, not necessarily PartNumber order.
+type indexedPartHashResult struct {
+	index int
+	partHashResult
+}
+
+// hashParts hashes each of parts, streaming one indexedPartHashResult per
+// part on the returned channel as soon as it's ready, then closing it. The
+// channel is buffered to hold every part's result, so a caller that stops
+// reading early (e.g. after the first failure) never blocks a worker. If
+// readerAt is non-nil, parts are hashed concurrently (bounded to parallel
+// workers at a time) using io.NewSectionReader against their precomputed
+// offsets; otherwise parts are read sequentially off of r, which must be
+// positioned at the start of the first part.
+func hashParts(r io.Reader, readerAt io.ReaderAt, parallel int, algorithm s3Types.ChecksumAlgorithm, parts []s3Types.ObjectPart, offsets []int64) <-chan indexedPartHashResult {
+	out := make(chan indexedPartHashResult, len(parts))
+
+	go func() {
+		defer close(out)
+
+		if readerAt != nil {
+			sem := make(chan struct{}, parallel)
+			var wg sync.WaitGroup
+			for i, part := range parts {
+				wg.Add(1)
+				sem <- struct{}{}
+				go func(i int, partSize int64) {
+					defer wg.Done()
+					defer func() { <-sem }()
+					partHash, err := newHash(algorithm)
+					if err != nil {
+						out <- indexedPartHashResult{index: i, partHashResult: partHashResult{err: err}}
+						return
+					}
+					sr := io.NewSectionReader(readerAt, offsets[i], partSize)
+					if _, err := io.Copy(partHash, sr); err != nil {
+						out <- indexedPartHashResult{index: i, partHashResult: partHashResult{err: err}}
+						return
+					}
+					out <- indexedPartHashResult{index: i, partHashResult: partHashResult{sum: partHash.Sum(nil)}}
+				}(i, aws.ToInt64(part.Size))
+			}
+			wg.Wait()
+			return
+		}
+
+		for i, part := range parts {
+			partHash, err := newHash(algorithm)
+			if err != nil {
+				out <- indexedPartHashResult{index: i, partHashResult: partHashResult{err: err}}
+				continue
+			}
+			if _, err := io.Copy(partHash, io.LimitReader(r, aws.ToInt64(part.Size))); err != nil {
+				out <- indexedPartHashResult{index: i, partHashResult: partHashResult{err: err}}
+				continue
+			}
+			out <- indexedPartHashResult{index: i, partHashResult: partHashResult{sum: partHash.Sum(nil)}}
+		}
+	}()
+
+	return out
+}
+
+// collectOrderedPartResults reads n results off ch, which may arrive out of
+// order when parts are hashed concurrently, and calls onReady with each one
+// in ascending PartNumber order as soon as it's available — so a caller can
+// print progress incrementally instead of waiting for every part to finish.
+// It stops and returns onReady's error as soon as onReady returns one.
+func collectOrderedPartResults(ch <-chan indexedPartHashResult, n int, onReady func(i int, result partHashResult) error) error {
+	pending := make(map[int]partHashResult, n)
+	next := 0
+	for next < n {
+		r, ok := <-ch
+		if !ok {
+			break
+		}
+		pending[r.index] = r.partHashResult
+		for {
+			result, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			if err := onReady(next, result); err != nil {
+				return err
+			}
+			next++
+		}
+	}
+	return nil
+}
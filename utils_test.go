@@ -0,0 +1,21 @@
+package main
+
+import (
+	"encoding/hex"
+	"hash/crc64"
+	"testing"
+)
+
+// TestCrc64NvmeCheckValue pins the CRC-64/NVME table against the standard
+// check value for "123456789" so a wrong polynomial doesn't regress silently.
+func TestCrc64NvmeCheckValue(t *testing.T) {
+	const want = "ae8b14860a799888"
+
+	h := crc64.New(crc64NvmeTable)
+	h.Write([]byte("123456789"))
+	got := hex.EncodeToString(h.Sum(nil))
+
+	if got != want {
+		t.Errorf("crc64NvmeTable check value = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Sentinel errors returned by verifyObject. Use errors.Is to distinguish
+// them from plain I/O/API errors, which are reported as-is.
+var (
+	errObjectNotFound = errors.New("the object does not exist")
+	errNoChecksum     = errors.New("object was not uploaded using the additional checksum feature")
+	errMismatch       = errors.New("checksum mismatch")
+)
+
+// verifyOptions holds the knobs that affect how verifyObject compares an S3
+// object against a local file. It is shared between the single-object CLI
+// path and the recursive prefix-vs-directory mode.
+type verifyOptions struct {
+	parallel   int
+	checkParts bool
+	etagMode   bool
+	partSize   int64
+	debug      bool
+	// quiet suppresses the per-object progress output (S3/local checksums,
+	// per-part OK/FAILED lines), which only makes sense for a single
+	// invocation. Errors are always returned, never suppressed.
+	quiet bool
+	// emitManifestPath, if set, appends a "<checksum>  <algorithm>  <s3uri>"
+	// line to this file every time verifyObject succeeds using an additional
+	// checksum (not --etag mode, which has nothing to record).
+	emitManifestPath string
+	// sseCustomerKey and sseCustomerKeyMD5 are the base64-encoded SSE-C key
+	// and its MD5, set together. When sseCustomerKey is empty, SSE-C headers
+	// are omitted entirely.
+	sseCustomerKey    string
+	sseCustomerKeyMD5 string
+	// requestPayer marks requests as coming from a requester-pays bucket's
+	// requester, rather than the bucket owner.
+	requestPayer bool
+}
+
+// applySSEAndPayer sets the SSE-C and requester-pays fields shared by every
+// GetObjectAttributes call on in.
+func applySSEAndPayer(in *s3.GetObjectAttributesInput, opts verifyOptions) {
+	if opts.sseCustomerKey != "" {
+		in.SSECustomerAlgorithm = aws.String("AES256")
+		in.SSECustomerKey = aws.String(opts.sseCustomerKey)
+		in.SSECustomerKeyMD5 = aws.String(opts.sseCustomerKeyMD5)
+	}
+	if opts.requestPayer {
+		in.RequestPayer = s3Types.RequestPayerRequester
+	}
+}
+
+// emitManifest appends a manifest line for bucket/key to opts.emitManifestPath,
+// in the same format that --check reads back.
+func emitManifest(opts verifyOptions, bucket, key, versionId, checksum string, algorithm s3Types.ChecksumAlgorithm) error {
+	if opts.emitManifestPath == "" {
+		return nil
+	}
+	s3Uri := fmt.Sprintf("s3://%s/%s", bucket, key)
+	if versionId != "" {
+		s3Uri += "?versionId=" + versionId
+	}
+	line := fmt.Sprintf("%s  %s  %s\n", checksum, algorithm, s3Uri)
+	f, err := os.OpenFile(opts.emitManifestPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(line)
+	return err
+}
+
+// verifyObject fetches bucket/key's attributes via GetObjectAttributes and
+// verifies them against the local file opened as f (which must be
+// positioned at the start). It returns nil on a match, an error wrapping
+// errMismatch if the contents differ, or any other error encountered along
+// the way.
+func verifyObject(ctx context.Context, client *s3.Client, bucket, key, versionId string, f *os.File, localPath string, opts verifyOptions) error {
+	if !opts.quiet {
+		fmt.Fprintln(os.Stderr, "Fetching S3 object information...")
+		if opts.debug {
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+
+	getObjectAttributesInput := &s3.GetObjectAttributesInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		ObjectAttributes: []s3Types.ObjectAttributes{
+			s3Types.ObjectAttributesEtag,
+			s3Types.ObjectAttributesChecksum,
+			s3Types.ObjectAttributesObjectParts,
+			s3Types.ObjectAttributesObjectSize,
+		},
+		MaxParts: aws.Int32(100000),
+	}
+	if versionId != "" {
+		getObjectAttributesInput.VersionId = aws.String(versionId)
+	}
+	applySSEAndPayer(getObjectAttributesInput, opts)
+	objAttrs, err := client.GetObjectAttributes(ctx, getObjectAttributesInput)
+	if err != nil {
+		if isSmithyErrorCode(err, 404) {
+			return errObjectNotFound
+		}
+		if isSmithyErrorCode(err, 400) && opts.sseCustomerKey != "" {
+			return fmt.Errorf("%w (the --sse-c-key may be incorrect for this object)", err)
+		}
+		return err
+	}
+
+	if opts.debug {
+		fmt.Fprintln(os.Stderr, string(jsonMustMarshalSortedIndent(objAttrs, "", "  ")))
+		fmt.Fprintln(os.Stderr)
+	}
+
+	if objAttrs.Checksum == nil && !opts.etagMode {
+		return errNoChecksum
+	}
+
+	// Compare the file sizes if possible
+	if localPath != "-" {
+		stat, err := os.Stat(localPath)
+		if err != nil {
+			return err
+		}
+		fileSize := stat.Size()
+		objectSize := aws.ToInt64(objAttrs.ObjectSize)
+		if objectSize != fileSize {
+			return fmt.Errorf("%w: the S3 object (%d bytes) does not match the size of the local file (%d bytes)", errMismatch, objectSize, fileSize)
+		}
+	}
+
+	if objAttrs.Checksum == nil {
+		// --etag fallback mode: no additional checksum is available, so
+		// verify against the classic S3 ETag instead.
+		etag := strings.Trim(aws.ToString(objAttrs.ETag), `"`)
+		if etag == "" {
+			return fmt.Errorf("the object has no ETag to fall back to")
+		}
+		var parts []s3Types.ObjectPart
+		if objAttrs.ObjectParts != nil {
+			parts = objAttrs.ObjectParts.Parts
+		}
+		return verifyETag(f, localPath, etag, aws.ToInt64(objAttrs.ObjectSize), parts, opts.partSize, opts.quiet)
+	}
+
+	algorithm, err := getChecksumAlgorithm(objAttrs.Checksum)
+	if err != nil {
+		return fmt.Errorf("this S3 object was uploaded using an unsupported checksum algorithm, please file an issue: https://github.com/stefansundin/s3verify")
+	}
+	objSum, err := getChecksum(objAttrs.Checksum, algorithm)
+	if err != nil {
+		return err
+	}
+	h, err := newHash(algorithm)
+	if err != nil {
+		return err
+	}
+
+	if !opts.quiet {
+		fmt.Printf("S3 object checksum: %s\n", objSum)
+	}
+
+	// A ReaderAt lets workers seek to their own part independently. This is
+	// not available for stdin, in which case hashParts falls back to a
+	// single goroutine reading the parts sequentially off of f.
+	var readerAt io.ReaderAt
+	if localPath != "-" {
+		if ra, ok := io.Reader(f).(io.ReaderAt); ok {
+			readerAt = ra
+		}
+	}
+
+	if objAttrs.Checksum.ChecksumType == s3Types.ChecksumTypeFullObject {
+		// FULL_OBJECT checksums are computed over the entire object in a
+		// single pass, even when the object was uploaded using multipart
+		// upload, so there is no checksum-of-checksums to reconstruct.
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		sum := base64.StdEncoding.EncodeToString(h.Sum(nil))
+		if !opts.quiet {
+			fmt.Println()
+			fmt.Printf("Local file checksum: %s\n", sum)
+			fmt.Println()
+		}
+		if sum != objSum {
+			return fmt.Errorf("%w: local file checksum %s does not match S3 object checksum %s", errMismatch, sum, objSum)
+		}
+
+		if opts.checkParts && objAttrs.ObjectParts != nil {
+			if readerAt == nil {
+				fmt.Fprintln(os.Stderr, "\nWarning: --check-parts was requested, but stdin does not support re-reading the parts. Skipping.")
+			} else if !opts.quiet {
+				// Suppressed under opts.quiet (recursive mode): this
+				// prints multiple lines per part, which would interleave with
+				// other keys' output when run concurrently.
+				crossCheckParts(objAttrs.ObjectParts.Parts, readerAt, opts.parallel, algorithm)
+			}
+		}
+		return emitManifest(opts, bucket, key, versionId, objSum, algorithm)
+	}
+
+	if objAttrs.ObjectParts == nil {
+		// Not a multi-part object:
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		sum := base64.StdEncoding.EncodeToString(h.Sum(nil))
+		if !opts.quiet {
+			fmt.Println()
+			fmt.Printf("Local file checksum: %s\n", sum)
+			fmt.Println()
+		}
+		if sum != objSum {
+			return fmt.Errorf("%w: local file checksum %s does not match S3 object checksum %s", errMismatch, sum, objSum)
+		}
+		return emitManifest(opts, bucket, key, versionId, objSum, algorithm)
+	}
+
+	// A multi-part object using the classic checksum-of-checksums (COMPOSITE):
+	numParts := int(aws.ToInt32(objAttrs.ObjectParts.TotalPartsCount))
+	if !opts.quiet {
+		fmt.Printf("Object consists of %d part%s.\n", numParts, pluralize(numParts))
+		fmt.Println()
+	}
+
+	if numParts != len(objAttrs.ObjectParts.Parts) || aws.ToBool(objAttrs.ObjectParts.IsTruncated) {
+		return fmt.Errorf("this S3 object has more parts than were returned in the response, please file an issue: https://github.com/stefansundin/s3verify")
+	}
+
+	partLengthDigits := 1 + int64(math.Floor(math.Log10(float64(numParts))))
+	partFmtStr := fmt.Sprintf("Part %%%dd: %%s  ", partLengthDigits)
+
+	// Compute each part's offset up front and validate that the parts are
+	// sorted, so that the hashing below can be done out of order.
+	offsets := make([]int64, numParts)
+	var offset int64
+	for i, part := range objAttrs.ObjectParts.Parts {
+		if int32(i+1) != aws.ToInt32(part.PartNumber) {
+			return fmt.Errorf("the parts of the S3 object are not sorted in the response, please file an issue: https://github.com/stefansundin/s3verify")
+		}
+		offsets[i] = offset
+		offset += aws.ToInt64(part.Size)
+	}
+
+	results := hashParts(f, readerAt, opts.parallel, algorithm, objAttrs.ObjectParts.Parts, offsets)
+
+	// Parts may finish hashing out of order when hashed concurrently, but we
+	// still want to print progress in PartNumber order as each one becomes
+	// available, rather than waiting for every part to finish.
+	err = collectOrderedPartResults(results, numParts, func(i int, result partHashResult) error {
+		part := objAttrs.ObjectParts.Parts[i]
+		partNumber := aws.ToInt32(part.PartNumber)
+		if result.err != nil {
+			return result.err
+		}
+		partSumEncoded := base64.StdEncoding.EncodeToString(result.sum)
+		if !opts.quiet {
+			fmt.Printf(partFmtStr, partNumber, partSumEncoded)
+		}
+		partChecksum, err := getPartChecksum(&part, algorithm)
+		if err != nil {
+			return err
+		}
+		if partSumEncoded != partChecksum {
+			if !opts.quiet {
+				fmt.Println("FAILED")
+			}
+			return fmt.Errorf("%w: local file did not match part %d (bytes %d to %d)", errMismatch, partNumber, offsets[i], offsets[i]+aws.ToInt64(part.Size))
+		}
+		if !opts.quiet {
+			fmt.Println("OK")
+		}
+		h.Write(result.sum)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sum := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	if len(sum) != len(objSum) {
+		// Directory buckets add the number of parts to the end of the checksum of checksums, separated with a dash
+		sum = fmt.Sprintf("%s-%d", sum, numParts)
+	}
+	if !opts.quiet {
+		fmt.Println()
+		fmt.Printf("Checksum of checksums: %s\n", sum)
+		fmt.Println()
+	}
+	if sum != objSum {
+		return fmt.Errorf("%w: checksum of checksums %s does not match S3 object checksum %s", errMismatch, sum, objSum)
+	}
+	return emitManifest(opts, bucket, key, versionId, objSum, algorithm)
+}
+
+// crossCheckParts re-hashes each part from readerAt and compares it against
+// the object's per-part checksums. This is purely an optional sanity check
+// for FULL_OBJECT checksums, which are already verified against the whole
+// object, so a mismatch here is reported but does not affect the result of
+// verifyObject.
+func crossCheckParts(parts []s3Types.ObjectPart, readerAt io.ReaderAt, parallel int, algorithm s3Types.ChecksumAlgorithm) {
+	numParts := len(parts)
+	fmt.Println()
+	fmt.Printf("Cross-checking %d part%s against the object's part checksums...\n", numParts, pluralize(numParts))
+	fmt.Println()
+
+	offsets := make([]int64, numParts)
+	var offset int64
+	for i, part := range parts {
+		offsets[i] = offset
+		offset += aws.ToInt64(part.Size)
+	}
+
+	partLengthDigits := 1 + int64(math.Floor(math.Log10(float64(numParts))))
+	partFmtStr := fmt.Sprintf("Part %%%dd: %%s  ", partLengthDigits)
+
+	results := hashParts(nil, readerAt, parallel, algorithm, parts, offsets)
+	collectOrderedPartResults(results, numParts, func(i int, result partHashResult) error {
+		part := parts[i]
+		partNumber := aws.ToInt32(part.PartNumber)
+		if result.err != nil {
+			fmt.Fprintf(os.Stderr, "Part %d: %v\n", partNumber, result.err)
+			return nil
+		}
+		partSumEncoded := base64.StdEncoding.EncodeToString(result.sum)
+		fmt.Printf(partFmtStr, partNumber, partSumEncoded)
+		partChecksum, err := getPartChecksum(&part, algorithm)
+		if err != nil {
+			fmt.Println(err)
+			return nil
+		}
+		if partSumEncoded != partChecksum {
+			fmt.Println("FAILED")
+			return nil
+		}
+		fmt.Println("OK")
+		return nil
+	})
+}
+
+// verifyETag implements --etag mode: verifying a local file against an S3
+// object's classic ETag when it has no additional checksum. Like
+// verifyObject, it returns nil on a match or an error wrapping errMismatch.
+func verifyETag(f *os.File, localPath string, etag string, objectSize int64, parts []s3Types.ObjectPart, partSize int64, quiet bool) error {
+	if !quiet {
+		fmt.Printf("S3 object ETag: %s\n", etag)
+	}
+
+	if !strings.Contains(etag, "-") {
+		// Single-part object: the ETag is the hex MD5 of the whole body.
+		hasher := md5.New()
+		if _, err := io.Copy(hasher, f); err != nil {
+			return err
+		}
+		sum := hex.EncodeToString(hasher.Sum(nil))
+		if !quiet {
+			fmt.Println()
+			fmt.Printf("Local file MD5: %s\n", sum)
+			fmt.Println()
+		}
+		if sum != etag {
+			return fmt.Errorf("%w: local file MD5 %s does not match S3 object ETag %s", errMismatch, sum, etag)
+		}
+		return nil
+	}
+
+	// Multipart object: the ETag is hex(md5(concat(md5(part_i))))-N.
+	fields := strings.SplitN(etag, "-", 2)
+	objectDigest := fields[0]
+	numParts, err := strconv.Atoi(fields[1])
+	if err != nil || numParts < 1 {
+		return fmt.Errorf("could not parse the part count out of the ETag %q", etag)
+	}
+	if !quiet {
+		fmt.Printf("Object consists of %d part%s.\n", numParts, pluralize(numParts))
+		fmt.Println()
+	}
+
+	partSizes, err := resolvePartSizes(parts, numParts, objectSize, partSize)
+	if err != nil {
+		return fmt.Errorf("%w, please specify --part-size", err)
+	}
+
+	var readerAt io.ReaderAt
+	if localPath != "-" {
+		if ra, ok := io.Reader(f).(io.ReaderAt); ok {
+			readerAt = ra
+		}
+	}
+
+	offsets := make([]int64, numParts)
+	var offset int64
+	for i, sz := range partSizes {
+		offsets[i] = offset
+		offset += sz
+	}
+
+	partLengthDigits := 1 + int64(math.Floor(math.Log10(float64(numParts))))
+	partFmtStr := fmt.Sprintf("Part %%%dd: %%s\n", partLengthDigits)
+
+	combined := md5.New()
+	for i := 0; i < numParts; i++ {
+		partHash := md5.New()
+		var err error
+		if readerAt != nil {
+			_, err = io.Copy(partHash, io.NewSectionReader(readerAt, offsets[i], partSizes[i]))
+		} else {
+			_, err = io.Copy(partHash, io.LimitReader(f, partSizes[i]))
+		}
+		if err != nil {
+			return err
+		}
+		partSum := partHash.Sum(nil)
+		if !quiet {
+			fmt.Printf(partFmtStr, i+1, hex.EncodeToString(partSum))
+		}
+		combined.Write(partSum)
+	}
+
+	combinedDigest := hex.EncodeToString(combined.Sum(nil))
+	if !quiet {
+		fmt.Println()
+		fmt.Printf("Checksum of checksums: %s-%d\n", combinedDigest, numParts)
+		fmt.Println()
+	}
+	if combinedDigest != objectDigest {
+		return fmt.Errorf("%w: checksum of checksums %s-%d does not match S3 object ETag %s", errMismatch, combinedDigest, numParts, etag)
+	}
+	return nil
+}